@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
@@ -15,6 +18,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -32,6 +37,13 @@ var defaultS3Bucket = "static.buffer.com"
 var uploader *s3manager.Uploader
 var svc *s3.S3
 
+// s3Endpoint and s3ForcePathStyle are set by SetupS3Uploader when a custom
+// S3-compatible endpoint is configured, and are consulted by GetFileURL to
+// build URLs against that endpoint instead of assuming s3.amazonaws.com.
+var s3Endpoint string
+var s3ForcePathStyle bool
+var s3DisableSSL bool
+
 func fatal(format string, a ...interface{}) {
 	s := "Error: " + format + "\n"
 	if a != nil {
@@ -54,6 +66,20 @@ func GetFileMd5(file *os.File) (string, error) {
 	return fileHash, nil
 }
 
+// GetFileFingerprints returns both an MD5 checksum and a subresource
+// integrity string (the SHA-384 digest, formatted as "sha384-<base64>") for
+// a file, computed in a single read
+func GetFileFingerprints(file *os.File) (checksum string, integrity string, err error) {
+	md5Hash := md5.New()
+	sha384Hash := sha512.New384()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha384Hash), file); err != nil {
+		return "", "", err
+	}
+	checksum = hex.EncodeToString(md5Hash.Sum(nil))
+	integrity = "sha384-" + base64.StdEncoding.EncodeToString(sha384Hash.Sum(nil))
+	return checksum, integrity, nil
+}
+
 // GetVersionedFilename returns a new filename with the version before the extension
 func GetVersionedFilename(filename string, version string) string {
 	ext := filepath.Ext(filename)
@@ -62,6 +88,71 @@ func GetVersionedFilename(filename string, version string) string {
 	return versionedFilename
 }
 
+// keyTemplateShortHashLen is the number of leading characters of the full
+// hash used for {{.ShortHash}}
+const keyTemplateShortHashLen = 8
+
+// KeyTemplateData is the set of variables available to a -key-template
+// template when rendering a file's bucket key
+type KeyTemplateData struct {
+	Dir       string
+	Name      string
+	Ext       string
+	Hash      string
+	ShortHash string
+	Date      string
+}
+
+// keyTemplatePresets are the built-in -key-template values selectable by
+// name, in addition to supplying a raw template string
+var keyTemplatePresets = map[string]string{
+	// default reproduces the original behaviour: only .js/.css files get a
+	// hash spliced in before their extension, everything else is untouched
+	"default":          `{{if ne .Dir "."}}{{.Dir}}/{{end}}{{.Name}}{{if or (eq .Ext ".js") (eq .Ext ".css")}}.{{.Hash}}{{end}}{{.Ext}}`,
+	"content-hash":     `assets/{{.ShortHash}}/{{.Hash}}{{.Ext}}`,
+	"date-partitioned": `{{.Date}}/{{if ne .Dir "."}}{{.Dir}}/{{end}}{{.Name}}{{.Ext}}`,
+	"flat":             `{{.Hash}}{{.Ext}}`,
+}
+
+// ResolveKeyTemplate parses a -key-template flag value into a template.
+// The value may name one of keyTemplatePresets, or be a raw text/template
+// string. An empty value returns a nil template, signalling callers to fall
+// back to the legacy hardcoded key logic.
+func ResolveKeyTemplate(nameOrTemplate string) (*template.Template, error) {
+	if nameOrTemplate == "" {
+		return nil, nil
+	}
+	text, ok := keyTemplatePresets[nameOrTemplate]
+	if !ok {
+		text = nameOrTemplate
+	}
+	return template.New("key").Parse(text)
+}
+
+// RenderKey renders a key template for a single file, returning the
+// template-computed filename (relative to the upload directory)
+func RenderKey(tmpl *template.Template, filename string, hash string) (string, error) {
+	ext := filepath.Ext(filename)
+	data := KeyTemplateData{
+		Dir:  filepath.Dir(filename),
+		Name: strings.TrimSuffix(filepath.Base(filename), ext),
+		Ext:  ext,
+		Hash: hash,
+		Date: time.Now().Format("2006/01/02"),
+	}
+	if len(hash) >= keyTemplateShortHashLen {
+		data.ShortHash = hash[:keyTemplateShortHashLen]
+	} else {
+		data.ShortHash = hash
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
 // GetFileMimeType returns the mime type of a file using it's extension
 func GetFileMimeType(filename string) string {
 	ext := filepath.Ext(filename)
@@ -84,22 +175,55 @@ func GetFilesFromGlobsList(globList string) ([]string, error) {
 	return files, nil
 }
 
-// SetupS3Uploader configures and assigns the global "uploader" and "svc" variables
-func SetupS3Uploader() {
+// S3Options holds the flags needed to target S3-compatible object stores
+// (MinIO, Ceph RGW, DigitalOcean Spaces, ...) instead of AWS S3 proper
+type S3Options struct {
+	Region           string
+	Endpoint         string
+	S3ForcePathStyle bool
+	DisableSSL       bool
+}
+
+// SetupS3Uploader configures and assigns the global "uploader" and "svc"
+// variables. Both are safe for concurrent use by multiple goroutines: the
+// AWS SDK's s3manager.Uploader and s3.S3 client are documented as
+// concurrency-safe, so VersionAndUploadFiles' worker pool can share them
+// without additional locking.
+func SetupS3Uploader(opts S3Options) {
 	awsAccessKeyID := os.Getenv("AWS_ACCESS_KEY_ID")
 	awsSecretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
 
-	creds := credentials.NewStaticCredentials(awsAccessKeyID, awsSecretAccessKey, "")
+	region := opts.Region
+	if region == "" {
+		region = endpoints.UsEast1RegionID
+	}
+
+	config := &aws.Config{
+		Region:           aws.String(region),
+		S3ForcePathStyle: aws.Bool(opts.S3ForcePathStyle),
+		DisableSSL:       aws.Bool(opts.DisableSSL),
+	}
+	if opts.Endpoint != "" {
+		config.Endpoint = aws.String(opts.Endpoint)
+	}
+
+	// Fall back to the default AWS credential chain (shared config, env,
+	// IAM role) when AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY aren't set,
+	// instead of forcing static (and possibly empty) credentials.
+	if awsAccessKeyID != "" && awsSecretAccessKey != "" {
+		config.Credentials = credentials.NewStaticCredentials(awsAccessKeyID, awsSecretAccessKey, "")
+	}
 
-	sess := session.Must(session.NewSession(&aws.Config{
-		Credentials: creds,
-		Region:      aws.String(endpoints.UsEast1RegionID),
-	}))
-	_, err := creds.Get()
+	sess := session.Must(session.NewSession(config))
+	_, err := sess.Config.Credentials.Get()
 	if err != nil {
 		fatal("failed to load AWS credentials %s", err)
 	}
 
+	s3Endpoint = strings.TrimPrefix(strings.TrimPrefix(opts.Endpoint, "https://"), "http://")
+	s3ForcePathStyle = opts.S3ForcePathStyle
+	s3DisableSSL = opts.DisableSSL
+
 	uploader = s3manager.NewUploader(sess)
 	svc = s3.New(sess)
 }
@@ -119,6 +243,16 @@ func HasPreviousUpload(svc *s3.S3, bucket string, filename string) bool {
 
 // GetFileURL returns the final url of the file
 func GetFileURL(bucket string, bucketFilename string) string {
+	if s3Endpoint != "" {
+		scheme := "https://"
+		if s3DisableSSL {
+			scheme = "http://"
+		}
+		if s3ForcePathStyle {
+			return scheme + path.Join(s3Endpoint, bucket, bucketFilename)
+		}
+		return scheme + path.Join(bucket+"."+s3Endpoint, bucketFilename)
+	}
 	// the static.buffer.com bucket has a domain alias
 	if bucket == defaultS3Bucket {
 		return "https://" + path.Join(bucket, bucketFilename)
@@ -126,88 +260,625 @@ func GetFileURL(bucket string, bucketFilename string) string {
 	return "https://s3.amazonaws.com" + path.Join("/", bucket, "/", bucketFilename)
 }
 
-// UploadFile uploads a given file to the s3 bucket
-func UploadFile(file *os.File, filename string, bucket string) (err error) {
-	mimeType := GetFileMimeType(filename)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket:       aws.String(bucket),
-		Key:          aws.String(filename),
-		ContentType:  aws.String(mimeType),
-		CacheControl: aws.String("public, max-age=31520626"),
+// defaultCacheControl is used when no -cache-control flag is given
+const defaultCacheControl = "public, max-age=31520626"
+
+// contentEncodingByExt maps a file extension to the Content-Encoding it
+// should be uploaded with
+var contentEncodingByExt = map[string]string{
+	".gz": "gzip",
+	".br": "br",
+}
+
+// UploadOptions carries everything needed to build an S3 upload request.
+// Keeping this as its own struct means future metadata additions don't keep
+// mutating UploadFile's signature.
+type UploadOptions struct {
+	Bucket          string
+	Key             string
+	Body            io.Reader
+	ContentType     string
+	ContentEncoding string
+	CacheControl    string
+	Fingerprint     string
+}
+
+// UploadFile uploads a given file to the s3 bucket and returns the SDK's
+// upload output, which callers can inspect for the ETag and, when the
+// bucket has versioning enabled, the assigned VersionId
+func UploadFile(opts UploadOptions) (*s3manager.UploadOutput, error) {
+	input := &s3manager.UploadInput{
+		Bucket:       aws.String(opts.Bucket),
+		Key:          aws.String(opts.Key),
+		ContentType:  aws.String(opts.ContentType),
+		CacheControl: aws.String(opts.CacheControl),
 		Expires:      aws.Time(time.Now().AddDate(10, 0, 0)),
-		Body:         file,
-	})
+		Body:         opts.Body,
+		Metadata: map[string]*string{
+			"fingerprint": aws.String(opts.Fingerprint),
+		},
+	}
+	if opts.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(opts.ContentEncoding)
+	}
+
+	output, err := uploader.Upload(input)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return output, nil
+}
+
+// detectContentEncoding returns the Content-Encoding implied by a filename's
+// extension (.gz, .br) and the mime type of the underlying, uncompressed
+// file, stripping that extension first
+func detectContentEncoding(filename string) (contentEncoding string, mimeType string) {
+	ext := filepath.Ext(filename)
+	encoding, ok := contentEncodingByExt[ext]
+	if !ok {
+		return "", GetFileMimeType(filename)
+	}
+	return encoding, GetFileMimeType(strings.TrimSuffix(filename, ext))
+}
+
+// ManifestEntry describes a single uploaded file in the versions manifest
+type ManifestEntry struct {
+	URL         string
+	File        string
+	Hash        string
+	Integrity   string
+	Size        int64
+	ContentType string
+}
+
+// uploadJob describes a single file to be versioned and uploaded by a worker
+type uploadJob struct {
+	index    int
+	filename string
+}
+
+// uploadResult carries the outcome of an uploadJob back to the collector
+type uploadResult struct {
+	index    int
+	filename string
+	entry    ManifestEntry
+	err      error
+}
+
+// processUploadJob versions and, unless dryRun is set, uploads a single file,
+// returning the uploadResult for the given job. When keyTmpl is non-nil, it
+// is rendered to compute the bucket key in place of the hardcoded
+// extension-based hashing logic.
+func processUploadJob(ctx context.Context, bucket string, directory string, dryRun bool, cacheControl string, precompressed bool, keyTmpl *template.Template, job uploadJob) uploadResult {
+	result := uploadResult{index: job.index, filename: job.filename}
+
+	select {
+	case <-ctx.Done():
+		result.err = ctx.Err()
+		return result
+	default:
+	}
+
+	file, err := os.Open(job.filename)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer file.Close()
+
+	// The fingerprint and integrity hash are attached to every upload's
+	// metadata/manifest entry, so both are computed up front in a single
+	// read and the checksum is reused for versioned naming
+	checksum, integrity, err := GetFileFingerprints(file)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		result.err = err
+		return result
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	var uploadFilename string
+	if keyTmpl != nil {
+		uploadFilename, err = RenderKey(keyTmpl, job.filename, checksum)
+		if err != nil {
+			result.err = err
+			return result
+		}
+	} else {
+		uploadFilename = job.filename
+		ext := filepath.Ext(job.filename)
+		if ext == ".js" || ext == ".css" {
+			uploadFilename = GetVersionedFilename(job.filename, checksum)
+		}
+	}
+	bucketFilename := path.Join(directory, uploadFilename)
+
+	contentEncoding, mimeType := detectContentEncoding(job.filename)
+
+	result.entry = ManifestEntry{
+		URL:         GetFileURL(bucket, bucketFilename),
+		File:        uploadFilename,
+		Hash:        checksum,
+		Integrity:   integrity,
+		Size:        fileInfo.Size(),
+		ContentType: mimeType,
+	}
+
+	shouldUpload := !HasPreviousUpload(svc, bucket, bucketFilename)
+	if shouldUpload && !dryRun {
+		_, err := UploadFile(UploadOptions{
+			Bucket:          bucket,
+			Key:             bucketFilename,
+			Body:            file,
+			ContentType:     mimeType,
+			ContentEncoding: contentEncoding,
+			CacheControl:    cacheControl,
+			Fingerprint:     checksum,
+		})
+		if err != nil {
+			result.err = err
+			return result
+		}
+	}
+
+	if shouldUpload {
+		fmt.Printf("%-10s %s\n", "Uploaded", job.filename)
+	} else {
+		fmt.Printf("%-10s %s\n", "Skipped", job.filename)
+	}
+
+	if precompressed && contentEncoding == "" {
+		if err := uploadPrecompressedVariants(bucket, bucketFilename, job.filename, mimeType, cacheControl, dryRun); err != nil {
+			result.err = err
+			return result
+		}
+	}
+
+	return result
+}
+
+// uploadPrecompressedVariants uploads foo.js.gz/foo.js.br siblings of a
+// source file, when present on disk, as their own S3 objects carrying the
+// correct Content-Encoding header
+func uploadPrecompressedVariants(bucket string, bucketFilename string, sourceFilename string, mimeType string, cacheControl string, dryRun bool) error {
+	for ext, encoding := range contentEncodingByExt {
+		siblingFilename := sourceFilename + ext
+		if _, err := os.Stat(siblingFilename); err != nil {
+			continue
+		}
+
+		siblingKey := bucketFilename + ext
+		shouldUpload := !HasPreviousUpload(svc, bucket, siblingKey)
+
+		if shouldUpload && !dryRun {
+			siblingFile, err := os.Open(siblingFilename)
+			if err != nil {
+				return err
+			}
+			defer siblingFile.Close()
+
+			checksum, err := GetFileMd5(siblingFile)
+			if err != nil {
+				return err
+			}
+			if _, err := siblingFile.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			_, err = UploadFile(UploadOptions{
+				Bucket:          bucket,
+				Key:             siblingKey,
+				Body:            siblingFile,
+				ContentType:     mimeType,
+				ContentEncoding: encoding,
+				CacheControl:    cacheControl,
+				Fingerprint:     checksum,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if shouldUpload {
+			fmt.Printf("%-10s %s\n", "Uploaded", siblingFilename)
+		} else {
+			fmt.Printf("%-10s %s\n", "Skipped", siblingFilename)
+		}
 	}
 	return nil
 }
 
-// VersionAndUploadFiles will verion files and upload them to s3 and return
-// a map of filenames and their version hashes
+// VersionAndUploadFiles will version files and upload them to s3 and return
+// a manifest of filenames to their ManifestEntry. Files are uploaded in
+// parallel across a worker pool of the given size. The first error
+// encountered cancels the work that has not started yet (uploads already
+// in progress run to completion), and the function then returns that
+// error with an empty manifest.
 func VersionAndUploadFiles(
 	bucket string,
 	directory string,
 	filenames []string,
 	dryRun bool,
-) (map[string]string, error) {
-	fileVersions := map[string]string{}
+	concurrency int,
+	keyTemplate string,
+	cacheControl string,
+	precompressed bool,
+) (map[string]ManifestEntry, error) {
+	manifest := map[string]ManifestEntry{}
 
 	fmt.Printf("Uploading to %s/%s\n", bucket, directory)
 
-	for _, filename := range filenames {
-		file, err := os.Open(filename)
+	keyTmpl, err := ResolveKeyTemplate(keyTemplate)
+	if err != nil {
+		return manifest, err
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(filenames) {
+		concurrency = len(filenames)
+	}
+	if concurrency == 0 {
+		return manifest, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := make(chan uploadJob)
+	results := make(chan uploadResult)
+
+	var workers sync.WaitGroup
+	workers.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				results <- processUploadJob(ctx, bucket, directory, dryRun, cacheControl, precompressed, keyTmpl, job)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i, filename := range filenames {
+			select {
+			case jobs <- uploadJob{index: i, filename: filename}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Close results once every worker has returned, rather than assuming
+	// len(filenames) results will arrive: the dispatcher above can abandon
+	// queuing the remaining jobs as soon as cancel() fires below, in which
+	// case fewer results than len(filenames) are ever produced.
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	var collectedResults []uploadResult
+	for result := range results {
+		collectedResults = append(collectedResults, result)
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+			cancel()
+		}
+	}
+
+	if firstErr != nil {
+		return manifest, firstErr
+	}
+
+	for _, result := range collectedResults {
+		manifest[result.filename] = result.entry
+	}
+
+	return manifest, nil
+}
+
+// S3VersionEntry describes one file uploaded under the "s3" versioning
+// strategy: its current URL, the VersionId S3 assigned it (when the bucket
+// has versioning enabled), and its ETag
+type S3VersionEntry struct {
+	URL       string `json:"url"`
+	VersionID string `json:"versionId,omitempty"`
+	ETag      string `json:"etag,omitempty"`
+}
+
+// s3VersionJob/s3VersionResult mirror uploadJob/uploadResult for the
+// "s3" versioning worker pool
+type s3VersionJob struct {
+	index    int
+	filename string
+}
+
+type s3VersionResult struct {
+	index    int
+	filename string
+	entry    S3VersionEntry
+	err      error
+}
+
+// processS3VersionJob uploads a single file under its original key (no
+// MD5-in-filename rewrite) and records the VersionId/ETag S3 assigns it
+func processS3VersionJob(ctx context.Context, bucket string, directory string, dryRun bool, cacheControl string, job s3VersionJob) s3VersionResult {
+	result := s3VersionResult{index: job.index, filename: job.filename}
+
+	select {
+	case <-ctx.Done():
+		result.err = ctx.Err()
+		return result
+	default:
+	}
+
+	file, err := os.Open(job.filename)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer file.Close()
+
+	checksum, err := GetFileMd5(file)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		result.err = err
+		return result
+	}
+
+	bucketFilename := path.Join(directory, job.filename)
+	result.entry.URL = GetFileURL(bucket, bucketFilename)
+
+	contentEncoding, mimeType := detectContentEncoding(job.filename)
+
+	if !dryRun {
+		output, err := UploadFile(UploadOptions{
+			Bucket:          bucket,
+			Key:             bucketFilename,
+			Body:            file,
+			ContentType:     mimeType,
+			ContentEncoding: contentEncoding,
+			CacheControl:    cacheControl,
+			Fingerprint:     checksum,
+		})
 		if err != nil {
-			return fileVersions, err
+			result.err = err
+			return result
+		}
+		if output.VersionID != nil {
+			result.entry.VersionID = *output.VersionID
 		}
-		defer file.Close()
+		if output.ETag != nil {
+			result.entry.ETag = strings.Trim(*output.ETag, "\"")
+		}
+	}
 
-		ext := filepath.Ext(filename)
-		uploadFilename := filename
-		if ext == ".js" || ext == ".css" {
-			checksum, errMd5 := GetFileMd5(file)
-			if errMd5 != nil {
-				return fileVersions, errMd5
+	fmt.Printf("%-10s %s\n", "Uploaded", job.filename)
+
+	return result
+}
+
+// VersionAndUploadFilesS3 uploads files under their original keys (relying
+// on S3 bucket versioning rather than filename hashing to distinguish
+// revisions) and returns a manifest mapping filename to its URL, VersionId,
+// and ETag. Like VersionAndUploadFiles, it fans work out across a worker
+// pool and cancels remaining work on the first error.
+func VersionAndUploadFilesS3(
+	bucket string,
+	directory string,
+	filenames []string,
+	dryRun bool,
+	concurrency int,
+	cacheControl string,
+) (map[string]S3VersionEntry, error) {
+	manifest := map[string]S3VersionEntry{}
+
+	fmt.Printf("Uploading to %s/%s (s3 versioning)\n", bucket, directory)
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > len(filenames) {
+		concurrency = len(filenames)
+	}
+	if concurrency == 0 {
+		return manifest, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := make(chan s3VersionJob)
+	results := make(chan s3VersionResult)
+
+	var workers sync.WaitGroup
+	workers.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				results <- processS3VersionJob(ctx, bucket, directory, dryRun, cacheControl, job)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for i, filename := range filenames {
+			select {
+			case jobs <- s3VersionJob{index: i, filename: filename}:
+			case <-ctx.Done():
+				return
 			}
-			uploadFilename = GetVersionedFilename(filename, checksum)
 		}
-		bucketFilename := path.Join(directory, uploadFilename)
-		fileURL := GetFileURL(bucket, bucketFilename)
+	}()
 
-		shouldUpload := !HasPreviousUpload(svc, bucket, bucketFilename)
-		if shouldUpload && !dryRun {
-			err := UploadFile(file, bucketFilename, bucket)
-			if err != nil {
-				return fileVersions, err
+	// Close results once every worker has returned, rather than assuming
+	// len(filenames) results will arrive: the dispatcher above can abandon
+	// queuing the remaining jobs as soon as cancel() fires below, in which
+	// case fewer results than len(filenames) are ever produced.
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var firstErr error
+	var collectedResults []s3VersionResult
+	for result := range results {
+		collectedResults = append(collectedResults, result)
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+			cancel()
+		}
+	}
+
+	if firstErr != nil {
+		return manifest, firstErr
+	}
+
+	for _, result := range collectedResults {
+		manifest[result.filename] = result.entry
+	}
+
+	return manifest, nil
+}
+
+// ListObjectVersionsForKey returns the historical versions of a single
+// bucket key, newest first, using s3.ListObjectVersions. ListObjectVersions
+// caps each response at 1000 entries across the whole bucket, so results
+// are paged with KeyMarker/VersionIdMarker until IsTruncated is false.
+func ListObjectVersionsForKey(svc *s3.S3, bucket string, key string) ([]*s3.ObjectVersion, error) {
+	var versions []*s3.ObjectVersion
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	}
+
+	for {
+		output, err := svc.ListObjectVersions(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, version := range output.Versions {
+			if version.Key != nil && *version.Key == key {
+				versions = append(versions, version)
 			}
 		}
 
-		if shouldUpload {
-			fmt.Printf("%-10s %s\n", "Uploaded", filename)
-		} else {
-			fmt.Printf("%-10s %s\n", "Skipped", filename)
+		if output.IsTruncated == nil || !*output.IsTruncated {
+			break
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.VersionIdMarker = output.NextVersionIdMarker
+	}
+
+	return versions, nil
+}
+
+// PinManifestToGeneration lists the historical versions of every entry in
+// an s3-versioning manifest and rewrites each entry's VersionID/URL to the
+// version `generationsBack` revisions before the current one (0 is the
+// current version), constructing rollback URLs with "?versionId=..."
+func PinManifestToGeneration(svc *s3.S3, bucket string, directory string, manifest map[string]S3VersionEntry, generationsBack int) (map[string]S3VersionEntry, error) {
+	pinned := map[string]S3VersionEntry{}
+
+	for filename := range manifest {
+		bucketFilename := path.Join(directory, filename)
+		versions, err := ListObjectVersionsForKey(svc, bucket, bucketFilename)
+		if err != nil {
+			return nil, err
+		}
+		if generationsBack >= len(versions) {
+			return nil, fmt.Errorf("only %d version(s) of %s are available, cannot go back %d", len(versions), filename, generationsBack)
 		}
 
-		fileVersions[filename] = fileURL
+		version := versions[generationsBack]
+		entry := S3VersionEntry{
+			URL: GetFileURL(bucket, bucketFilename) + "?versionId=" + aws.StringValue(version.VersionId),
+		}
+		if version.VersionId != nil {
+			entry.VersionID = *version.VersionId
+		}
+		if version.ETag != nil {
+			entry.ETag = strings.Trim(*version.ETag, "\"")
+		}
+		pinned[filename] = entry
 	}
 
-	return fileVersions, nil
+	return pinned, nil
+}
+
+// sriManifestEntry is the shape of each entry in a -format=sri manifest
+type sriManifestEntry struct {
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+}
+
+// webpackManifestEntry is the shape of each entry in a -format=webpack
+// manifest, matching what webpack-manifest-plugin / vite produce
+type webpackManifestEntry struct {
+	File      string `json:"file"`
+	Src       string `json:"src"`
+	Integrity string `json:"integrity,omitempty"`
 }
 
-// FormatManifest returns the file version manifest in json or csv format
-func FormatManifest(fileVersions map[string]string, format string) ([]byte, error) {
-	if format == "json" {
+// FormatManifest returns the file version manifest in one of several
+// output shapes: "json" (the original flat filename -> url map), "csv"
+// (filename,url rows), "sri" (filename -> {url, integrity} for dropping
+// straight into <script integrity="..."> tags), or "webpack" (the nested
+// schema expected by webpack-manifest-plugin / vite)
+func FormatManifest(manifest map[string]ManifestEntry, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		fileVersions := map[string]string{}
+		for filename, entry := range manifest {
+			fileVersions[filename] = entry.URL
+		}
 		return json.MarshalIndent(fileVersions, "", "  ")
-	}
-	if format == "csv" {
+	case "csv":
 		b := &bytes.Buffer{}
 		wr := csv.NewWriter(b)
-		for filename, uri := range fileVersions {
-			row := []string{filename, uri}
+		for filename, entry := range manifest {
+			row := []string{filename, entry.URL}
 			wr.Write(row)
 		}
 		wr.Flush()
 		return b.Bytes(), nil
+	case "sri":
+		sriManifest := map[string]sriManifestEntry{}
+		for filename, entry := range manifest {
+			sriManifest[filename] = sriManifestEntry{
+				URL:       entry.URL,
+				Integrity: entry.Integrity,
+			}
+		}
+		return json.MarshalIndent(sriManifest, "", "  ")
+	case "webpack":
+		webpackManifest := map[string]webpackManifestEntry{}
+		for filename, entry := range manifest {
+			webpackManifest[filename] = webpackManifestEntry{
+				File:      entry.File,
+				Src:       filename,
+				Integrity: entry.Integrity,
+			}
+		}
+		return json.MarshalIndent(webpackManifest, "", "  ")
 	}
 	return nil, nil
 }
@@ -217,8 +888,19 @@ func main() {
 	directory := flag.String("dir", "", "required, the directory to upload files to in the bucket")
 	filesArg := flag.String("files", "", "the path to the files you'd like to upload, ex. \"public/**/.*js,public/style.css\"")
 	outputFilename := flag.String("o", "staticAssets.json", "the filename for the versions manifest")
-	format := flag.String("format", "json", "format of the output [json,csv]")
+	format := flag.String("format", "json", "format of the output [json,csv,sri,webpack]")
 	dryRun := flag.Bool("dry-run", false, "print the output only, skip file uploads and manifest creation")
+	concurrency := flag.Int("concurrency", 8, "the number of files to upload in parallel")
+	region := flag.String("region", "", "the aws region to connect to, defaults to us-east-1")
+	endpoint := flag.String("endpoint", "", "a custom S3-compatible endpoint, ex. for MinIO, Ceph RGW or DigitalOcean Spaces")
+	s3ForcePathStyle := flag.Bool("s3-force-path-style", false, "use path-style addressing (bucket as part of the path) instead of virtual-hosted-style")
+	disableSSL := flag.Bool("disable-ssl", false, "disable SSL when talking to the S3 endpoint")
+	versioning := flag.String("versioning", "hash", "versioning strategy to use [hash,s3]")
+	listVersions := flag.Bool("list-versions", false, "list historical S3 object versions for each entry in the manifest (-versioning=s3 only); combine with -pin-generation to regenerate a manifest pinned to a prior version")
+	pinGeneration := flag.Int("pin-generation", -1, "with -list-versions, regenerate the manifest pinned to this many versions back from current (0 is the current version)")
+	keyTemplate := flag.String("key-template", "", "a text/template string (or preset name: default, content-hash, date-partitioned, flat) for computing each file's bucket key; defaults to the original .js/.css hashing logic")
+	cacheControl := flag.String("cache-control", defaultCacheControl, "the Cache-Control header to set on uploaded objects")
+	precompressed := flag.Bool("precompressed", false, "also upload foo.js.gz/foo.js.br siblings of each file, if present on disk, with the matching Content-Encoding (not supported with -versioning=s3)")
 	printVersion := flag.Bool("v", false, "print the current buffer-static-upload version")
 	flag.Parse()
 
@@ -231,6 +913,25 @@ func main() {
 		fatal("To use the default bucket you need to specify an upload directory (-dir)")
 	}
 
+	if *versioning == "s3" && *precompressed {
+		fatal("-precompressed is not supported with -versioning=s3")
+	}
+
+	s3Opts := S3Options{
+		Region:           *region,
+		Endpoint:         *endpoint,
+		S3ForcePathStyle: *s3ForcePathStyle,
+		DisableSSL:       *disableSSL,
+	}
+
+	if *listVersions {
+		SetupS3Uploader(s3Opts)
+		if err := ListVersions(*s3Bucket, *directory, *outputFilename, *pinGeneration); err != nil {
+			fatal("failed to list versions %s", err)
+		}
+		return
+	}
+
 	start := time.Now()
 	files, err := GetFilesFromGlobsList(*filesArg)
 	if err != nil {
@@ -238,15 +939,27 @@ func main() {
 	}
 	fmt.Printf("Found %d files to upload and version:\n", len(files))
 
-	SetupS3Uploader()
-	fileVersions, err := VersionAndUploadFiles(*s3Bucket, *directory, files, *dryRun)
-	if err != nil {
-		fatal("failed to upload files %s", err)
-	}
+	SetupS3Uploader(s3Opts)
 
-	output, err := FormatManifest(fileVersions, *format)
-	if err != nil {
-		fatal("failed to format versions manifest file %s", err)
+	var output []byte
+	if *versioning == "s3" {
+		manifest, err := VersionAndUploadFilesS3(*s3Bucket, *directory, files, *dryRun, *concurrency, *cacheControl)
+		if err != nil {
+			fatal("failed to upload files %s", err)
+		}
+		output, err = json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			fatal("failed to format versions manifest file %s", err)
+		}
+	} else {
+		fileVersions, err := VersionAndUploadFiles(*s3Bucket, *directory, files, *dryRun, *concurrency, *keyTemplate, *cacheControl, *precompressed)
+		if err != nil {
+			fatal("failed to upload files %s", err)
+		}
+		output, err = FormatManifest(fileVersions, *format)
+		if err != nil {
+			fatal("failed to format versions manifest file %s", err)
+		}
 	}
 
 	if !*dryRun {
@@ -268,3 +981,54 @@ func main() {
 		)
 	}
 }
+
+// ListVersions reads an existing s3-versioning manifest from manifestFilename
+// and prints the historical S3 object versions for each of its entries. When
+// pinGeneration is >= 0, it also regenerates the manifest pinned to that many
+// versions back from current and overwrites manifestFilename with it.
+func ListVersions(bucket string, directory string, manifestFilename string, pinGeneration int) error {
+	data, err := ioutil.ReadFile(manifestFilename)
+	if err != nil {
+		return err
+	}
+
+	var manifest map[string]S3VersionEntry
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+
+	for filename := range manifest {
+		bucketFilename := path.Join(directory, filename)
+		versions, err := ListObjectVersionsForKey(svc, bucket, bucketFilename)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s:\n", filename)
+		for i, version := range versions {
+			fmt.Printf(
+				"  %-3d %-34s %s\n",
+				i,
+				aws.StringValue(version.VersionId),
+				aws.TimeValue(version.LastModified),
+			)
+		}
+	}
+
+	if pinGeneration >= 0 {
+		pinned, err := PinManifestToGeneration(svc, bucket, directory, manifest, pinGeneration)
+		if err != nil {
+			return err
+		}
+		output, err := json.MarshalIndent(pinned, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(manifestFilename, output, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("\nPinned %s to %d generation(s) back\n", manifestFilename, pinGeneration)
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestGetVersionedFilename(t *testing.T) {
+	got := GetVersionedFilename("app.js", "deadbeef")
+	want := "app.deadbeef.js"
+	if got != want {
+		t.Errorf("GetVersionedFilename() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveKeyTemplateAndRenderKey(t *testing.T) {
+	tmpl, err := ResolveKeyTemplate("flat")
+	if err != nil {
+		t.Fatalf("ResolveKeyTemplate() error = %v", err)
+	}
+	key, err := RenderKey(tmpl, "js/app.js", "deadbeef")
+	if err != nil {
+		t.Fatalf("RenderKey() error = %v", err)
+	}
+	if key != "deadbeef.js" {
+		t.Errorf("RenderKey() = %q, want %q", key, "deadbeef.js")
+	}
+
+	if tmpl, err := ResolveKeyTemplate(""); err != nil || tmpl != nil {
+		t.Errorf("ResolveKeyTemplate(\"\") = %v, %v, want nil, nil", tmpl, err)
+	}
+}
+
+// TestRenderKeyDirAndNameComposition guards against Name carrying the
+// directory component that Dir already provides: a template combining both
+// (the natural way to use two separately-offered path variables) must not
+// double the directory, and a bare {{.Name}}{{.Ext}} must flatten the path.
+func TestRenderKeyDirAndNameComposition(t *testing.T) {
+	dirAndName, err := template.New("key").Parse(`{{.Dir}}/{{.Name}}{{.Ext}}`)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	key, err := RenderKey(dirAndName, "public/js/app.js", "deadbeef")
+	if err != nil {
+		t.Fatalf("RenderKey() error = %v", err)
+	}
+	if key != "public/js/app.js" {
+		t.Errorf("RenderKey() = %q, want %q", key, "public/js/app.js")
+	}
+
+	flatten, err := template.New("key").Parse(`{{.Name}}{{.Ext}}`)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	key, err = RenderKey(flatten, "public/js/app.js", "deadbeef")
+	if err != nil {
+		t.Fatalf("RenderKey() error = %v", err)
+	}
+	if key != "app.js" {
+		t.Errorf("RenderKey() = %q, want %q", key, "app.js")
+	}
+}
+
+func TestRenderKeyDefaultPreset(t *testing.T) {
+	tmpl, err := ResolveKeyTemplate("default")
+	if err != nil {
+		t.Fatalf("ResolveKeyTemplate() error = %v", err)
+	}
+
+	if key, err := RenderKey(tmpl, "app.js", "deadbeef"); err != nil || key != "app.deadbeef.js" {
+		t.Errorf("RenderKey(top-level) = %q, %v, want %q, nil", key, err, "app.deadbeef.js")
+	}
+	if key, err := RenderKey(tmpl, "public/js/app.js", "deadbeef"); err != nil || key != "public/js/app.deadbeef.js" {
+		t.Errorf("RenderKey(nested) = %q, %v, want %q, nil", key, err, "public/js/app.deadbeef.js")
+	}
+	if key, err := RenderKey(tmpl, "public/logo.png", "deadbeef"); err != nil || key != "public/logo.png" {
+		t.Errorf("RenderKey(non-versioned, nested) = %q, %v, want %q, nil", key, err, "public/logo.png")
+	}
+}
+
+func TestDetectContentEncoding(t *testing.T) {
+	tests := []struct {
+		filename     string
+		wantEncoding string
+	}{
+		{"app.js", ""},
+		{"app.js.gz", "gzip"},
+		{"app.js.br", "br"},
+	}
+	for _, tt := range tests {
+		encoding, _ := detectContentEncoding(tt.filename)
+		if encoding != tt.wantEncoding {
+			t.Errorf("detectContentEncoding(%q) encoding = %q, want %q", tt.filename, encoding, tt.wantEncoding)
+		}
+	}
+}
+
+func TestFormatManifestJSON(t *testing.T) {
+	manifest := map[string]ManifestEntry{
+		"app.js": {URL: "https://static.buffer.com/app.deadbeef.js"},
+	}
+	out, err := FormatManifest(manifest, "json")
+	if err != nil {
+		t.Fatalf("FormatManifest() error = %v", err)
+	}
+	if !strings.Contains(string(out), "https://static.buffer.com/app.deadbeef.js") {
+		t.Errorf("FormatManifest() = %s, want it to contain the entry URL", out)
+	}
+}
+
+func TestGetFileFingerprints(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.js")
+	if err := ioutil.WriteFile(path, []byte("console.log('hi')"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer file.Close()
+
+	checksum, integrity, err := GetFileFingerprints(file)
+	if err != nil {
+		t.Fatalf("GetFileFingerprints() error = %v", err)
+	}
+	if checksum == "" || !strings.HasPrefix(integrity, "sha384-") {
+		t.Errorf("GetFileFingerprints() = %q, %q, want non-empty md5 and sha384-prefixed integrity", checksum, integrity)
+	}
+}
+
+// fakeS3Server stands in for S3 behind VersionAndUploadFiles: HEAD always
+// misses (no previous upload), and PUT to errorKey fails with a
+// non-retryable 400 so the upload path's worker pool surfaces an error
+// the same way a real S3 rejection would.
+func fakeS3Server(t *testing.T, errorKey string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case http.MethodPut:
+			if strings.Contains(r.URL.Path, errorKey) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`<Error><Code>BadRequest</Code><Message>rejected</Message></Error>`))
+				return
+			}
+			w.Header().Set("ETag", `"fake-etag"`)
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// TestVersionAndUploadFilesReturnsOnError is a regression test for a
+// dispatcher/collector deadlock: the collector used to loop exactly
+// len(filenames) times reading from results, but the dispatcher can abandon
+// queuing the remaining jobs as soon as an error cancels the context, so
+// fewer results than len(filenames) are ever produced. Guard with a timeout
+// so a reintroduced deadlock fails the test instead of hanging forever.
+func TestVersionAndUploadFilesReturnsOnError(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	server := fakeS3Server(t, "file00")
+	defer server.Close()
+
+	SetupS3Uploader(S3Options{
+		Endpoint:         server.URL,
+		S3ForcePathStyle: true,
+		DisableSSL:       true,
+	})
+
+	dir := t.TempDir()
+	var filenames []string
+	for i := 0; i < 12; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%02d", i))
+		if err := ioutil.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		filenames = append(filenames, path)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := VersionAndUploadFiles("test-bucket", "", filenames, false, 3, "", "", false)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("VersionAndUploadFiles() error = nil, want the upload error to be propagated")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("VersionAndUploadFiles() did not return within 5s after a job error; collector likely deadlocked")
+	}
+}